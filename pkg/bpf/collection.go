@@ -0,0 +1,276 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package bpf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/cilium/ebpf"
+
+	"github.com/cilium/cilium/pkg/bpf/verifierlog"
+)
+
+// maxVerifierLogRetries bounds the number of times LoadCollection will
+// double the verifier log buffer before giving up.
+const maxVerifierLogRetries = 5
+
+// LoadCollectionOptions extends ebpf.CollectionOptions with knobs applied by
+// LoadCollection itself, on top of what the underlying ebpf-go library
+// offers.
+type LoadCollectionOptions struct {
+	ebpf.CollectionOptions
+
+	// ComplexityBudget, if non-nil, is checked against the verifier log
+	// produced by a successful load. LoadCollection fails the load if any
+	// program's measured complexity exceeds its budget.
+	ComplexityBudget *ComplexityBudget
+
+	// Globals supplies values for the named globals declared in
+	// globalConfigMap, see relocateGlobals.
+	Globals map[string]any
+}
+
+// LoadCollection loads the programs and maps contained in spec into the
+// kernel. Before loading, global data and config is resolved into the
+// spec's instructions, see relocateGlobals.
+//
+// If the caller requested a verifier log and the kernel's response was
+// truncated, LoadCollection doubles the requested log size and retries, up
+// to maxVerifierLogRetries times.
+//
+// If opts.ComplexityBudget is set, the verifier log of every loaded program
+// is parsed and checked against the budget. A program exceeding its budget
+// causes LoadCollection to return a *ComplexityBudgetExceededError, even
+// though the load itself succeeded.
+func LoadCollection(spec *ebpf.CollectionSpec, opts LoadCollectionOptions) (*ebpf.Collection, error) {
+	if err := relocateGlobals(spec, opts.Globals); err != nil {
+		return nil, fmt.Errorf("relocating globals: %w", err)
+	}
+
+	// A complexity budget requires a verifier log to check against. Force
+	// at least instruction-level logging if the caller didn't ask for
+	// one, since the stats we need (peak states, stack depth) are only
+	// emitted at that level.
+	if opts.ComplexityBudget != nil && opts.Programs.LogLevel == 0 {
+		opts.Programs.LogLevel = ebpf.LogLevelInstruction
+	}
+	if opts.ComplexityBudget != nil && opts.Programs.LogSize == 0 {
+		opts.Programs.LogSize = defaultVerifierLogSize
+	}
+
+	var (
+		coll *ebpf.Collection
+		err  error
+	)
+
+	for i := 0; ; i++ {
+		coll, err = ebpf.NewCollectionWithOptions(spec, opts.CollectionOptions)
+		if err == nil {
+			break
+		}
+
+		if opts.Programs.LogSize == 0 || !isVerifierLogTruncated(err) || i == maxVerifierLogRetries {
+			return nil, err
+		}
+
+		opts.Programs.LogSize *= 2
+	}
+
+	if opts.ComplexityBudget != nil {
+		if err := opts.ComplexityBudget.check(coll); err != nil {
+			return coll, err
+		}
+	}
+
+	return coll, nil
+}
+
+// defaultVerifierLogSize is the initial verifier log buffer requested when a
+// ComplexityBudget is in effect but the caller didn't size one themselves.
+const defaultVerifierLogSize = 64 * 1024
+
+// isVerifierLogTruncated reports whether err indicates that the verifier log
+// buffer supplied to the kernel was too small to hold the full log.
+func isVerifierLogTruncated(err error) bool {
+	var ve *ebpf.VerifierError
+	if !errors.As(err, &ve) {
+		return false
+	}
+	return ve.Truncated
+}
+
+// ProgramComplexity holds the verifier metrics measured for a single loaded
+// program.
+type ProgramComplexity struct {
+	// ProcessedInsns is the highest "processed N insns" counter reported
+	// across all summary lines in the program's verifier log. A program
+	// with subprograms gets one summary line per subprogram; the highest
+	// is taken as representative of the program's overall cost.
+	ProcessedInsns int
+	// PeakStates is the largest peak_states value reported.
+	PeakStates int
+	// MaxStatesPerInsn is the largest max_states_per_insn value reported.
+	MaxStatesPerInsn int
+	// StackDepth is the largest stack depth reported across the
+	// program's functions.
+	StackDepth int
+}
+
+// parseProgramComplexity extracts ProgramComplexity from a raw verifier log
+// using package verifierlog. It tolerates both LogLevelBranch and
+// LogLevelInstruction output, as well as logs truncated by the kernel:
+// metrics found before the truncation point are still returned.
+func parseProgramComplexity(log []byte) ProgramComplexity {
+	report, err := verifierlog.Parse(log)
+	if err != nil {
+		return ProgramComplexity{}
+	}
+
+	c := ProgramComplexity{
+		ProcessedInsns:   report.Summary.ProcessedInsns,
+		PeakStates:       report.Summary.PeakStates,
+		MaxStatesPerInsn: report.Summary.MaxStatesPerInsn,
+	}
+
+	for _, fn := range report.Functions {
+		if fn.StackDepth > c.StackDepth {
+			c.StackDepth = fn.StackDepth
+		}
+	}
+
+	return c
+}
+
+// ProgramBudget is the set of verifier metrics a single program must stay
+// within. A zero field is treated as "no limit" for that metric.
+type ProgramBudget struct {
+	ProcessedInsns   int `json:"processedInsns,omitempty"`
+	PeakStates       int `json:"peakStates,omitempty"`
+	MaxStatesPerInsn int `json:"maxStatesPerInsn,omitempty"`
+	StackDepth       int `json:"stackDepth,omitempty"`
+}
+
+// exceeds reports whether c exceeds b, along with a human-readable
+// description of the first metric that does.
+func (b ProgramBudget) exceeds(c ProgramComplexity) (string, bool) {
+	switch {
+	case b.ProcessedInsns > 0 && c.ProcessedInsns > b.ProcessedInsns:
+		return fmt.Sprintf("processed insns %d > budget %d", c.ProcessedInsns, b.ProcessedInsns), true
+	case b.PeakStates > 0 && c.PeakStates > b.PeakStates:
+		return fmt.Sprintf("peak states %d > budget %d", c.PeakStates, b.PeakStates), true
+	case b.MaxStatesPerInsn > 0 && c.MaxStatesPerInsn > b.MaxStatesPerInsn:
+		return fmt.Sprintf("max states per insn %d > budget %d", c.MaxStatesPerInsn, b.MaxStatesPerInsn), true
+	case b.StackDepth > 0 && c.StackDepth > b.StackDepth:
+		return fmt.Sprintf("stack depth %d > budget %d", c.StackDepth, b.StackDepth), true
+	}
+	return "", false
+}
+
+// ComplexityBudget bounds the verifier complexity of one or more programs in
+// a Collection. Programs are matched by name against Programs; Default
+// applies to any program without a specific entry.
+type ComplexityBudget struct {
+	Default  *ProgramBudget           `json:"default,omitempty"`
+	Programs map[string]ProgramBudget `json:"programs,omitempty"`
+}
+
+// LoadComplexityBudgetFile reads a ComplexityBudget previously written by
+// WriteFile from path.
+func LoadComplexityBudgetFile(path string) (*ComplexityBudget, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading complexity budget: %w", err)
+	}
+
+	var budget ComplexityBudget
+	if err := json.Unmarshal(b, &budget); err != nil {
+		return nil, fmt.Errorf("parsing complexity budget: %w", err)
+	}
+
+	return &budget, nil
+}
+
+// WriteFile persists b to path as JSON, so that CI can gate future loads
+// against the same budget.
+func (b *ComplexityBudget) WriteFile(path string) error {
+	out, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshaling complexity budget: %w", err)
+	}
+
+	if err := os.WriteFile(path, out, 0o644); err != nil {
+		return fmt.Errorf("writing complexity budget: %w", err)
+	}
+
+	return nil
+}
+
+// budgetFor returns the budget that applies to the named program, if any.
+func (b *ComplexityBudget) budgetFor(name string) (ProgramBudget, bool) {
+	if pb, ok := b.Programs[name]; ok {
+		return pb, true
+	}
+	if b.Default != nil {
+		return *b.Default, true
+	}
+	return ProgramBudget{}, false
+}
+
+// ProgramOverBudget describes a single program whose measured verifier
+// complexity exceeded its configured budget.
+type ProgramOverBudget struct {
+	Name       string
+	Reason     string
+	Complexity ProgramComplexity
+	Budget     ProgramBudget
+}
+
+// ComplexityBudgetExceededError is returned by LoadCollection when one or
+// more loaded programs exceed their ComplexityBudget. The load itself has
+// already succeeded; callers may choose to tear the Collection down or keep
+// it despite the violation.
+type ComplexityBudgetExceededError struct {
+	Programs []ProgramOverBudget
+}
+
+func (e *ComplexityBudgetExceededError) Error() string {
+	return fmt.Sprintf("%d program(s) exceeded their complexity budget: %s", len(e.Programs), e.Programs[0].describe())
+}
+
+func (p ProgramOverBudget) describe() string {
+	return fmt.Sprintf("%s (%s)", p.Name, p.Reason)
+}
+
+// check measures every program in coll against b and returns a
+// *ComplexityBudgetExceededError listing every offender, or nil if all
+// programs stayed within budget.
+func (b *ComplexityBudget) check(coll *ebpf.Collection) error {
+	var over []ProgramOverBudget
+
+	for name, prog := range coll.Programs {
+		budget, ok := b.budgetFor(name)
+		if !ok {
+			continue
+		}
+
+		c := parseProgramComplexity(prog.VerifierLog)
+		if reason, exceeded := budget.exceeds(c); exceeded {
+			over = append(over, ProgramOverBudget{
+				Name:       name,
+				Reason:     reason,
+				Complexity: c,
+				Budget:     budget,
+			})
+		}
+	}
+
+	if len(over) == 0 {
+		return nil
+	}
+
+	return &ComplexityBudgetExceededError{Programs: over}
+}
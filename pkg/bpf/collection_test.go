@@ -5,6 +5,7 @@ package bpf
 
 import (
 	"encoding/binary"
+	"errors"
 	"testing"
 
 	"github.com/cilium/ebpf"
@@ -36,15 +37,17 @@ func TestLoadCollectionResizeLogBuffer(t *testing.T) {
 		},
 	}
 
-	coll, err := LoadCollection(spec, ebpf.CollectionOptions{
-		Programs: ebpf.ProgramOptions{
-			// Request instruction-level verifier state to ensure sufficient
-			// output is generated by the verifier. For example, one instruction:
-			// 0: (bf) r0 = r1		; R0_w=ctx(off=0,imm=0) R1=ctx(off=0,imm=0)
-			LogLevel: ebpf.LogLevelInstruction,
-			// Set the minimum buffer size the kernel will accept. LoadCollection is
-			// expected to grow this sufficiently over multiple tries.
-			LogSize: 128,
+	coll, err := LoadCollection(spec, LoadCollectionOptions{
+		CollectionOptions: ebpf.CollectionOptions{
+			Programs: ebpf.ProgramOptions{
+				// Request instruction-level verifier state to ensure sufficient
+				// output is generated by the verifier. For example, one instruction:
+				// 0: (bf) r0 = r1		; R0_w=ctx(off=0,imm=0) R1=ctx(off=0,imm=0)
+				LogLevel: ebpf.LogLevelInstruction,
+				// Set the minimum buffer size the kernel will accept. LoadCollection is
+				// expected to grow this sufficiently over multiple tries.
+				LogSize: 128,
+			},
 		},
 	})
 	if err != nil {
@@ -58,6 +61,44 @@ func TestLoadCollectionResizeLogBuffer(t *testing.T) {
 	}
 }
 
+// Load a program referencing a named global config tunable through
+// LoadCollection end to end, to prove relocateGlobals' resolved value
+// survives the real ebpf.NewCollectionWithOptions map-relocation pass
+// rather than being clobbered by it, and that the now-unreferenced
+// .rodata.config map is never created in the kernel.
+func TestLoadCollectionGlobalConfig(t *testing.T) {
+	testutils.PrivilegedTest(t)
+
+	spec := &ebpf.CollectionSpec{
+		ByteOrder: binary.LittleEndian,
+		Maps: map[string]*ebpf.MapSpec{
+			globalConfigMap: {},
+		},
+		Programs: map[string]*ebpf.ProgramSpec{
+			"test": {
+				Type:    ebpf.SocketFilter,
+				License: "MIT",
+				Instructions: asm.Instructions{
+					asm.LoadMapValue(asm.R0, 0, 0).WithReference(globalConfigMap).WithSymbol("enable_foo"),
+					asm.Return(),
+				},
+			},
+		},
+	}
+
+	coll, err := LoadCollection(spec, LoadCollectionOptions{
+		Globals: map[string]any{"enable_foo": uint32(0x2a)},
+	})
+	if err != nil {
+		t.Fatal("Error loading collection:", err)
+	}
+	defer coll.Close()
+
+	if _, ok := spec.Maps[globalConfigMap]; ok {
+		t.Errorf("expected %s to be dropped before the collection was loaded", globalConfigMap)
+	}
+}
+
 func TestInlineGlobalData(t *testing.T) {
 	spec := &ebpf.CollectionSpec{
 		ByteOrder: binary.LittleEndian,
@@ -96,9 +137,155 @@ func TestInlineGlobalData(t *testing.T) {
 	if want, got := "func1", ins.Symbol(); want != got {
 		t.Errorf("unexpected Symbol value of Instruction: want: %s, got: %s", want, got)
 	}
+	if got := ins.Reference(); got != "" {
+		t.Errorf("expected Reference to be cleared so LoadCollection doesn't re-fix up this instruction against %s, got: %s", globalDataMap, got)
+	}
 
 	ins = spec.Programs["prog1"].Instructions[1]
 	if want, got := 0x1, int(ins.Constant); want != got {
 		t.Errorf("unexpected Instruction constant: want: 0x%x, got: 0x%x", want, got)
 	}
-}
\ No newline at end of file
+
+	if _, ok := spec.Maps[globalDataMap]; ok {
+		t.Errorf("expected %s to be dropped once every reference to it was resolved", globalDataMap)
+	}
+}
+
+func TestResolveGlobalConfig(t *testing.T) {
+	spec := &ebpf.CollectionSpec{
+		ByteOrder: binary.LittleEndian,
+		Maps: map[string]*ebpf.MapSpec{
+			globalConfigMap: {},
+		},
+		Programs: map[string]*ebpf.ProgramSpec{
+			"prog1": {
+				Instructions: asm.Instructions{
+					// Narrow tunable. Its replacement must keep the
+					// pseudo-load's double-width form so that jump offsets compiled after it
+					// (below) aren't thrown off by a shrunk instruction
+					// stream.
+					asm.LoadMapValue(asm.R1, 0, 0).WithReference(globalConfigMap).WithSymbol("enable_foo"),
+					// Jump whose target lies after the narrow tunable above;
+					// catches any rewrite that changes that instruction's
+					// encoded width.
+					asm.JEq.Imm(asm.R1, 0, "skip"),
+					// Wide tunable.
+					asm.LoadMapValue(asm.R2, 0, 8).WithReference(globalConfigMap).WithSymbol("rate_limit"),
+					asm.Return().WithSymbol("skip"),
+				},
+			},
+		},
+	}
+
+	err := resolveGlobalConfig(spec, map[string]any{
+		"enable_foo": true,
+		"rate_limit": uint64(1_000_000),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ins := spec.Programs["prog1"].Instructions[0]
+	if want, got := 1, int(ins.Constant); want != got {
+		t.Errorf("unexpected constant for enable_foo: want: %d, got: %d", want, got)
+	}
+	if want, got := "enable_foo", ins.Symbol(); want != got {
+		t.Errorf("unexpected Symbol value of Instruction: want: %s, got: %s", want, got)
+	}
+	if got := ins.Reference(); got != "" {
+		t.Errorf("expected Reference to be cleared so LoadCollection doesn't re-fix up this instruction against %s, got: %s", globalConfigMap, got)
+	}
+
+	ins = spec.Programs["prog1"].Instructions[2]
+	if want, got := uint64(1_000_000), uint64(ins.Constant); want != got {
+		t.Errorf("unexpected constant for rate_limit: want: %d, got: %d", want, got)
+	}
+	if want, got := "rate_limit", ins.Symbol(); want != got {
+		t.Errorf("unexpected Symbol value of Instruction: want: %s, got: %s", want, got)
+	}
+
+	if _, ok := spec.Maps[globalConfigMap]; ok {
+		t.Errorf("expected %s to be dropped once every reference to it was resolved", globalConfigMap)
+	}
+}
+
+func TestResolveGlobalConfigUnresolved(t *testing.T) {
+	spec := &ebpf.CollectionSpec{
+		Maps: map[string]*ebpf.MapSpec{
+			globalConfigMap: {},
+		},
+		Programs: map[string]*ebpf.ProgramSpec{
+			"prog1": {
+				Instructions: asm.Instructions{
+					asm.LoadMapValue(asm.R1, 0, 0).WithReference(globalConfigMap).WithSymbol("missing"),
+					asm.Return(),
+				},
+			},
+		},
+	}
+
+	if err := resolveGlobalConfig(spec, nil); err == nil {
+		t.Fatal("expected an error for an unresolved global")
+	}
+}
+
+func TestParseProgramComplexity(t *testing.T) {
+	// func#0 processes the most instructions but has the smallest
+	// peak_states/max_states_per_insn; func#1 is the reverse. The
+	// reported complexity must reflect the worst of both, not just
+	// whichever summary line has the highest ProcessedInsns.
+	log := []byte(
+		"0: (bf) r0 = r1\n" +
+			"1: (95) exit\n" +
+			"processed 9 insns (limit 1000000) max_states_per_insn 0 total_states 1 peak_states 1 mark_read 1\n" +
+			"func#1 @8\n" +
+			"stack depth 16+0\n" +
+			"processed 2 insns (limit 1000000) max_states_per_insn 2 total_states 4 peak_states 3 mark_read 2\n",
+	)
+
+	c := parseProgramComplexity(log)
+	if want, got := 9, c.ProcessedInsns; want != got {
+		t.Errorf("unexpected ProcessedInsns: want: %d, got: %d", want, got)
+	}
+	if want, got := 3, c.PeakStates; want != got {
+		t.Errorf("unexpected PeakStates: want: %d, got: %d", want, got)
+	}
+	if want, got := 2, c.MaxStatesPerInsn; want != got {
+		t.Errorf("unexpected MaxStatesPerInsn: want: %d, got: %d", want, got)
+	}
+	if want, got := 16, c.StackDepth; want != got {
+		t.Errorf("unexpected StackDepth: want: %d, got: %d", want, got)
+	}
+}
+
+func TestComplexityBudgetCheck(t *testing.T) {
+	budget := &ComplexityBudget{
+		Default: &ProgramBudget{ProcessedInsns: 100},
+		Programs: map[string]ProgramBudget{
+			"strict": {ProcessedInsns: 5},
+		},
+	}
+
+	coll := &ebpf.Collection{
+		Programs: map[string]*ebpf.Program{
+			"strict": {VerifierLog: []byte("processed 9 insns (limit 1000000) max_states_per_insn 0 total_states 1 peak_states 1 mark_read 1\n")},
+			"lax":    {VerifierLog: []byte("processed 9 insns (limit 1000000) max_states_per_insn 0 total_states 1 peak_states 1 mark_read 1\n")},
+		},
+	}
+
+	err := budget.check(coll)
+	if err == nil {
+		t.Fatal("expected complexity budget to be exceeded")
+	}
+
+	var exceeded *ComplexityBudgetExceededError
+	if !errors.As(err, &exceeded) {
+		t.Fatalf("unexpected error type: %T", err)
+	}
+	if want, got := 1, len(exceeded.Programs); want != got {
+		t.Fatalf("unexpected number of offending programs: want: %d, got: %d", want, got)
+	}
+	if want, got := "strict", exceeded.Programs[0].Name; want != got {
+		t.Errorf("unexpected offending program: want: %s, got: %s", want, got)
+	}
+}
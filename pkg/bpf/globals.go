@@ -0,0 +1,214 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package bpf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+)
+
+const (
+	// globalDataMap is the name of the map generated by the BPF compiler
+	// to hold global variables referenced by a program. Its contents are
+	// inlined into the program's instructions at load time so the
+	// verifier can track them as constants instead of requiring a map
+	// lookup at runtime.
+	globalDataMap = ".rodata"
+
+	// globalConfigMap is the name of the map the compiler emits for named
+	// tunables, e.g. `volatile const __u32 my_config;` declared in a
+	// `.rodata.config` section. Unlike globalDataMap, whose value is
+	// baked in at compile time, instructions referencing globalConfigMap
+	// carry a Symbol() naming the tunable so the loader can patch in a
+	// value chosen at runtime.
+	globalConfigMap = ".rodata.config"
+)
+
+// relocateGlobals rewrites a CollectionSpec's instructions to resolve two
+// kinds of compile-time globals before the spec is handed to the verifier:
+//
+//   - numeric constants stored in globalDataMap, inlined directly into the
+//     Constant field of the instructions that reference them; and
+//   - named tunables declared in globalConfigMap, resolved from the values
+//     supplied in globals.
+//
+// Both forms exist so a program can treat configuration the same way
+// whether it's baked in by the compiler or chosen by the agent at load
+// time, without requiring either map to actually be created in the kernel:
+// once every instruction referencing a map has been resolved to a plain
+// immediate, the map itself is dropped from the spec.
+//
+// relocateGlobals returns an error naming every global referenced by the
+// spec but missing from, or type-mismatched with, globals.
+func relocateGlobals(spec *ebpf.CollectionSpec, globals map[string]any) error {
+	if err := inlineGlobalData(spec); err != nil {
+		return err
+	}
+
+	return resolveGlobalConfig(spec, globals)
+}
+
+// inlineGlobalData resolves numeric constants stored in globalDataMap into
+// a map-independent immediate load, removing the need for the map to be
+// created and looked up at runtime.
+func inlineGlobalData(spec *ebpf.CollectionSpec) error {
+	m, ok := spec.Maps[globalDataMap]
+	if !ok || len(m.Contents) == 0 {
+		return nil
+	}
+
+	data, ok := m.Contents[0].Value.([]byte)
+	if !ok {
+		return fmt.Errorf("%s: contents are not raw bytes", globalDataMap)
+	}
+
+	order := byteOrder(spec)
+	patched := false
+
+	for name, prog := range spec.Programs {
+		for i, ins := range prog.Instructions {
+			if ins.Reference() != globalDataMap {
+				continue
+			}
+
+			// A BPF_PSEUDO_MAP_VALUE load carries the offset into the map
+			// value in the upper 32 bits of Constant, the map fd in the
+			// lower 32.
+			off := int(uint64(ins.Constant) >> 32)
+			if off+4 > len(data) {
+				return fmt.Errorf("%s: instruction %d of program %s references offset %d beyond map contents", globalDataMap, i, name, off)
+			}
+
+			value := int64(order.Uint32(data[off : off+4]))
+			prog.Instructions[i] = replaceWithImmediate(ins, value)
+			patched = true
+		}
+	}
+
+	// Now that nothing references it, drop the map so LoadCollection
+	// never creates it in the kernel.
+	if patched {
+		delete(spec.Maps, globalDataMap)
+	}
+
+	return nil
+}
+
+// resolveGlobalConfig patches instructions referencing globalConfigMap with
+// the value named by their Symbol(), taken from globals.
+func resolveGlobalConfig(spec *ebpf.CollectionSpec, globals map[string]any) error {
+	if _, ok := spec.Maps[globalConfigMap]; !ok {
+		return nil
+	}
+
+	unresolved := map[string]struct{}{}
+	mismatched := map[string]string{}
+	patched := false
+
+	for _, prog := range spec.Programs {
+		for i, ins := range prog.Instructions {
+			if ins.Reference() != globalConfigMap {
+				continue
+			}
+
+			name := ins.Symbol()
+			if name == "" {
+				return fmt.Errorf("%s: instruction %d of program %s has no symbol to resolve", globalConfigMap, i, prog.Name)
+			}
+
+			value, ok := globals[name]
+			if !ok {
+				unresolved[name] = struct{}{}
+				continue
+			}
+
+			encoded, err := encodeGlobal(value)
+			if err != nil {
+				mismatched[name] = err.Error()
+				continue
+			}
+
+			prog.Instructions[i] = replaceWithImmediate(ins, int64(encoded))
+			patched = true
+		}
+	}
+
+	if len(unresolved) > 0 || len(mismatched) > 0 {
+		problems := make([]string, 0, len(unresolved)+len(mismatched))
+		for name := range unresolved {
+			problems = append(problems, fmt.Sprintf("%q: unresolved", name))
+		}
+		for name, reason := range mismatched {
+			problems = append(problems, fmt.Sprintf("%q: %s", name, reason))
+		}
+		sort.Strings(problems)
+		return fmt.Errorf("%s: unresolved or mismatched global(s): %v", globalConfigMap, problems)
+	}
+
+	// Now that nothing references it, drop the map so LoadCollection
+	// never creates it in the kernel.
+	if patched {
+		delete(spec.Maps, globalConfigMap)
+	}
+
+	return nil
+}
+
+// encodeGlobal converts value into its host-endian uint64 representation.
+// The result is written directly into an instruction's Constant field, the
+// same as any other plain immediate: ebpf.CollectionSpec.Marshal applies
+// spec.ByteOrder when it encodes the instruction stream, so no manual
+// byte-order handling belongs here. Doing it here too, as an earlier
+// version of this code did, double-applies the byte swap for any
+// BigEndian spec.
+func encodeGlobal(value any) (uint64, error) {
+	switch v := value.(type) {
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case uint8:
+		return uint64(v), nil
+	case uint16:
+		return uint64(v), nil
+	case uint32:
+		return uint64(v), nil
+	case uint64:
+		return v, nil
+	default:
+		return 0, fmt.Errorf("unsupported type %T, want bool/u8/u16/u32/u64", value)
+	}
+}
+
+// replaceWithImmediate returns a replacement for ins that loads value
+// directly, preserving ins's Metadata (Symbol, func_info, line info) but
+// clearing its map Reference.
+//
+// ins is a BPF_PSEUDO_MAP_VALUE pseudo-load pointing at a global data or
+// config map. If we left that reference in place, LoadCollection's call
+// into ebpf.NewCollectionWithOptions would still create the map and run its
+// own map-relocation pass over every instruction referencing it, patching
+// the map's real fd on top of the Constant we just resolved here. Building
+// a plain immediate load instead detaches the instruction from the map
+// entirely, so the value we just wrote stays put. It keeps the same
+// double-slot width as the pseudo-load it replaces, so jump offsets
+// elsewhere in the program, which are compiled as fixed counts of 8-byte
+// instruction slots, stay aligned.
+func replaceWithImmediate(ins asm.Instruction, value int64) asm.Instruction {
+	out := asm.LoadImm(ins.Dst, value, asm.DWord)
+	out.Metadata = ins.Metadata
+	return out.WithReference("")
+}
+
+func byteOrder(spec *ebpf.CollectionSpec) binary.ByteOrder {
+	if spec.ByteOrder != nil {
+		return spec.ByteOrder
+	}
+	return binary.LittleEndian
+}
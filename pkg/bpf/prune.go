@@ -0,0 +1,167 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package bpf
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+
+	"github.com/cilium/cilium/pkg/datapath/linux/probes"
+)
+
+// Requirements declares the kernel features a program, identified by its ELF
+// section name, or a map, identified by its name in the CollectionSpec,
+// needs in order to be loaded. A single compiled
+// object can therefore carry variants of a program for different kernel
+// generations side by side, with PruneUnsupported picking the ones that fit
+// the running kernel.
+type Requirements struct {
+	// Helpers lists BPF helpers the program must be able to call. Only
+	// meaningful for program sections.
+	Helpers []RequiredHelper
+	// ProgramTypes lists program types the kernel must support. Only
+	// meaningful for program sections.
+	ProgramTypes []ebpf.ProgramType
+	// MapTypes lists map types the kernel must support.
+	MapTypes []ebpf.MapType
+	// MinKernel is the minimum kernel version the section requires.
+	MinKernel probes.KernelVersion
+	// StubReturn, if non-nil, tells PruneUnsupported to replace an
+	// unsupported program with a trivial one that just returns this
+	// value, instead of removing it from the spec entirely. This is used
+	// for programs that are tail-called and must therefore always be
+	// present in the program array, even as a no-op. Limited to int32
+	// since it's encoded as the immediate of a single BPF_MOV64_IMM
+	// instruction, which itself only carries a 32-bit immediate.
+	StubReturn *int32
+}
+
+// RequiredHelper names a BPF helper a program section needs to be able to
+// call, in the context of a specific program type.
+type RequiredHelper struct {
+	Prog   ebpf.ProgramType
+	Helper asm.BuiltinFunc
+}
+
+var (
+	requirementsMu sync.RWMutex
+	requirements   = map[string]Requirements{}
+)
+
+// RegisterRequirements associates section with the kernel features it
+// needs. section is matched against ProgramSpec.SectionName for programs
+// and against the map's name for maps. It is typically called from an init() function alongside the Go
+// code that embeds the compiled object exposing that section, so the
+// requirement travels with the program regardless of which agent
+// component ends up loading it.
+func RegisterRequirements(section string, reqs Requirements) {
+	requirementsMu.Lock()
+	defer requirementsMu.Unlock()
+	requirements[section] = reqs
+}
+
+// PruneUnsupported walks spec and removes programs and maps whose
+// Requirements (registered via RegisterRequirements) aren't satisfied by
+// probes. Sections without registered requirements are left untouched. It
+// returns the names of everything that was pruned.
+//
+// A program whose Requirements set StubReturn is not removed but replaced
+// with a minimal program that returns the configured value, so that
+// references to it (e.g. tail call maps) remain valid.
+func PruneUnsupported(spec *ebpf.CollectionSpec, fp *probes.FeatureProbes) ([]string, error) {
+	requirementsMu.RLock()
+	defer requirementsMu.RUnlock()
+
+	var pruned []string
+
+	for name, prog := range spec.Programs {
+		reqs, ok := requirements[prog.SectionName]
+		if !ok {
+			continue
+		}
+
+		if supported(reqs, fp) {
+			continue
+		}
+
+		if reqs.StubReturn != nil {
+			// License is left untouched: it's declared by the spec, not
+			// by PruneUnsupported, and the kernel checks it against the
+			// helpers the (now trivial) program actually calls, which
+			// are none.
+			prog.Instructions = asm.Instructions{
+				asm.Mov.Imm(asm.R0, *reqs.StubReturn),
+				asm.Return(),
+			}
+			pruned = append(pruned, name)
+			continue
+		}
+
+		delete(spec.Programs, name)
+		pruned = append(pruned, name)
+	}
+
+	for name, m := range spec.Maps {
+		reqs, ok := requirements[name]
+		if !ok {
+			continue
+		}
+		if supported(reqs, fp) {
+			continue
+		}
+
+		delete(spec.Maps, name)
+		pruned = append(pruned, name)
+		if err := unresolveMapReferences(spec, name); err != nil {
+			return pruned, err
+		}
+	}
+
+	return pruned, nil
+}
+
+// supported reports whether fp satisfies reqs.
+func supported(reqs Requirements, fp *probes.FeatureProbes) bool {
+	if !fp.KernelVersion().AtLeast(reqs.MinKernel) {
+		return false
+	}
+
+	for _, t := range reqs.ProgramTypes {
+		if !fp.HaveProgramType(t) {
+			return false
+		}
+	}
+
+	for _, t := range reqs.MapTypes {
+		if !fp.HaveMapType(t) {
+			return false
+		}
+	}
+
+	for _, h := range reqs.Helpers {
+		if !fp.HaveProgramHelper(h.Prog, h.Helper) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// unresolveMapReferences errors out if any remaining program still
+// references a map that PruneUnsupported just removed, since loading such a
+// spec would otherwise fail deep inside the kernel loader with a far less
+// actionable error.
+func unresolveMapReferences(spec *ebpf.CollectionSpec, mapName string) error {
+	for progName, prog := range spec.Programs {
+		for _, ins := range prog.Instructions {
+			if ins.Reference() == mapName {
+				return fmt.Errorf("program %s references pruned map %s without a registered stub", progName, mapName)
+			}
+		}
+	}
+	return nil
+}
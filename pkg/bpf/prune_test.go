@@ -0,0 +1,79 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package bpf
+
+import (
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+
+	"github.com/cilium/cilium/pkg/datapath/linux/probes"
+	"github.com/cilium/cilium/pkg/testutils"
+)
+
+// Register a program whose section no running kernel in CI supports, and
+// one stubbed the same way, then confirm PruneUnsupported removes the
+// former and replaces the latter instead of leaving both for the verifier
+// to reject.
+func TestPruneUnsupported(t *testing.T) {
+	testutils.PrivilegedTest(t)
+
+	const (
+		unsupportedSection = "cilium/test-unsupported"
+		stubbedSection     = "cilium/test-stubbed"
+	)
+
+	stub := int32(0)
+	RegisterRequirements(unsupportedSection, Requirements{
+		MinKernel: probes.KernelVersion{Major: 99},
+	})
+	RegisterRequirements(stubbedSection, Requirements{
+		MinKernel:  probes.KernelVersion{Major: 99},
+		StubReturn: &stub,
+	})
+
+	spec := &ebpf.CollectionSpec{
+		Programs: map[string]*ebpf.ProgramSpec{
+			"unsupported": {
+				Type:         ebpf.SocketFilter,
+				License:      "MIT",
+				SectionName:  unsupportedSection,
+				Instructions: asm.Instructions{asm.Mov.Imm(asm.R0, 1), asm.Return()},
+			},
+			"stubbed": {
+				Type:         ebpf.SocketFilter,
+				License:      "MIT",
+				SectionName:  stubbedSection,
+				Instructions: asm.Instructions{asm.Mov.Imm(asm.R0, 1), asm.Return()},
+			},
+		},
+	}
+
+	fp, err := probes.NewFeatureProbes()
+	if err != nil {
+		t.Fatal("Error probing kernel features:", err)
+	}
+
+	pruned, err := PruneUnsupported(spec, fp)
+	if err != nil {
+		t.Fatal("Error pruning collection:", err)
+	}
+
+	if len(pruned) != 2 {
+		t.Fatalf("expected 2 pruned sections, got %d: %v", len(pruned), pruned)
+	}
+
+	if _, ok := spec.Programs["unsupported"]; ok {
+		t.Error("unsupported program was not removed")
+	}
+
+	stubbed, ok := spec.Programs["stubbed"]
+	if !ok {
+		t.Fatal("stubbed program was removed instead of stubbed")
+	}
+	if want, got := "MIT", stubbed.License; want != got {
+		t.Errorf("stub program's declared license was changed: want: %s, got: %s", want, got)
+	}
+}
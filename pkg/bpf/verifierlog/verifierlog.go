@@ -0,0 +1,223 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+// Package verifierlog parses the raw verifier log the kernel attaches to a
+// loaded BPF program into a structured form, so operators and tests can
+// inspect verifier output programmatically instead of grepping strings.
+package verifierlog
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/cilium/ebpf"
+)
+
+// Report is the structured result of parsing a verifier log.
+type Report struct {
+	// Instructions holds one entry per disassembled instruction line.
+	// Only populated when the log was produced with LogLevelInstruction
+	// or LogLevelBranch.
+	Instructions []Instruction
+	// Functions holds one entry per function boundary the verifier
+	// reported, in the order encountered.
+	Functions []Function
+	// Summary merges the verifier summary lines found in the log.
+	// Multi-function programs emit one summary per subprogram; Summary
+	// holds the highest value seen for each field, see Summary.
+	Summary Summary
+	// Partial is true when the log appears to have been cut short by an
+	// undersized kernel buffer rather than ending cleanly.
+	Partial bool
+}
+
+// Instruction is a single disassembled line of a verifier log.
+type Instruction struct {
+	// Index is the instruction's position within its program.
+	Index int
+	// Text is the disassembled instruction, e.g. "(bf) r0 = r1".
+	Text string
+	// State holds the register/stack state the verifier printed after
+	// the instruction, keyed by register or stack slot name (e.g. "R0",
+	// "R1_w", "fp-8"). Empty unless LogLevelInstruction was requested.
+	State map[string]string
+	// Jump is true if Text is a conditional or unconditional jump.
+	Jump bool
+	// JumpTarget is the instruction index Text jumps to, valid only when
+	// Jump is true.
+	JumpTarget int
+}
+
+// Function marks the start of a subprogram within the verifier log.
+type Function struct {
+	// Index is the subprogram's ordinal, as in "func#<Index>".
+	Index int
+	// Insn is the instruction index the subprogram starts at.
+	Insn int
+	// StackDepth is the stack frame size the verifier computed for this
+	// subprogram, or 0 if the log didn't include one.
+	StackDepth int
+}
+
+// Summary is the per-program complexity summary the kernel appends to a
+// verifier log, e.g.:
+//
+//	processed 1234 insns (limit 1000000) max_states_per_insn 3 total_states 56 peak_states 7 mark_read 8
+//
+// A program with subprograms gets one such line per subprogram, each of
+// which may be the worst offender for a different field (one subprogram
+// processes the most instructions, another peaks at more states). Report's
+// Summary therefore holds the highest value seen per field independently,
+// not the fields of whichever single line had the highest ProcessedInsns,
+// see mergeMax.
+type Summary struct {
+	ProcessedInsns   int
+	MaxStatesPerInsn int
+	TotalStates      int
+	PeakStates       int
+	MarkRead         int
+}
+
+// mergeMax folds other into s, keeping the larger value for each field
+// independently.
+func (s *Summary) mergeMax(other Summary) {
+	if other.ProcessedInsns > s.ProcessedInsns {
+		s.ProcessedInsns = other.ProcessedInsns
+	}
+	if other.MaxStatesPerInsn > s.MaxStatesPerInsn {
+		s.MaxStatesPerInsn = other.MaxStatesPerInsn
+	}
+	if other.TotalStates > s.TotalStates {
+		s.TotalStates = other.TotalStates
+	}
+	if other.PeakStates > s.PeakStates {
+		s.PeakStates = other.PeakStates
+	}
+	if other.MarkRead > s.MarkRead {
+		s.MarkRead = other.MarkRead
+	}
+}
+
+var (
+	insnRE       = regexp.MustCompile(`^(\d+): (\([0-9a-fA-F]{2}\) .+)$`)
+	funcRE       = regexp.MustCompile(`^func#(\d+) @(\d+)$`)
+	stackDepthRE = regexp.MustCompile(`^stack depth (\d+)`)
+	summaryRE    = regexp.MustCompile(`^processed (\d+) insns \(limit \d+\) max_states_per_insn (\d+) total_states (\d+) peak_states (\d+) mark_read (\d+)`)
+	jumpRE       = regexp.MustCompile(`goto pc([+-]\d+)`)
+)
+
+// Parse parses a raw verifier log into a Report. It tolerates both
+// LogLevelBranch and LogLevelInstruction output, logs truncated mid-line by
+// an undersized kernel buffer, and empty input, for which it returns a
+// zero-value Report and no error.
+func Parse(log []byte) (*Report, error) {
+	report := &Report{}
+	if len(log) == 0 {
+		return report, nil
+	}
+
+	var currentFunc *Function
+
+	scanner := bufio.NewScanner(bytes.NewReader(log))
+	// The kernel can legitimately emit very long per-instruction state
+	// lines; grow well past bufio.Scanner's 64KiB default rather than
+	// erroring out on a line that's merely long.
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if m := funcRE.FindStringSubmatch(line); m != nil {
+			idx, _ := strconv.Atoi(m[1])
+			insn, _ := strconv.Atoi(m[2])
+			report.Functions = append(report.Functions, Function{Index: idx, Insn: insn})
+			currentFunc = &report.Functions[len(report.Functions)-1]
+			continue
+		}
+
+		if m := stackDepthRE.FindStringSubmatch(line); m != nil && currentFunc != nil {
+			currentFunc.StackDepth, _ = strconv.Atoi(m[1])
+			continue
+		}
+
+		if m := summaryRE.FindStringSubmatch(line); m != nil {
+			report.Summary.mergeMax(Summary{
+				ProcessedInsns:   atoi(m[1]),
+				MaxStatesPerInsn: atoi(m[2]),
+				TotalStates:      atoi(m[3]),
+				PeakStates:       atoi(m[4]),
+				MarkRead:         atoi(m[5]),
+			})
+			continue
+		}
+
+		if m := insnRE.FindStringSubmatch(line); m != nil {
+			idx, _ := strconv.Atoi(m[1])
+			ins := Instruction{Index: idx}
+
+			text, state, hasState := strings.Cut(m[2], "; ")
+			ins.Text = strings.TrimSpace(text)
+			if hasState {
+				ins.State = parseState(state)
+			}
+
+			if jm := jumpRE.FindStringSubmatch(ins.Text); jm != nil {
+				off, _ := strconv.Atoi(jm[1])
+				ins.Jump = true
+				ins.JumpTarget = idx + 1 + off
+			}
+
+			report.Instructions = append(report.Instructions, ins)
+			continue
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return report, fmt.Errorf("scanning verifier log: %w", err)
+	}
+
+	report.Partial = isTruncated(log)
+
+	return report, nil
+}
+
+// ReportFor parses the verifier log attached to prog. ebpf.Program is
+// defined in the cilium/ebpf library, so this is a function rather than a
+// method on that type.
+func ReportFor(prog *ebpf.Program) (*Report, error) {
+	return Parse(prog.VerifierLog)
+}
+
+// parseState splits a trailing "R0=... R1=..." annotation into a map keyed
+// by register or stack slot name.
+func parseState(s string) map[string]string {
+	state := map[string]string{}
+	for _, tok := range strings.Fields(s) {
+		k, v, ok := strings.Cut(tok, "=")
+		if !ok {
+			continue
+		}
+		state[k] = v
+	}
+	return state
+}
+
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+// isTruncated reports whether log looks like it was cut off mid-line by an
+// undersized kernel buffer, rather than ending on a summary line.
+func isTruncated(log []byte) bool {
+	trimmed := bytes.TrimRight(log, "\n")
+	last := trimmed
+	if idx := bytes.LastIndexByte(trimmed, '\n'); idx >= 0 {
+		last = trimmed[idx+1:]
+	}
+	return !summaryRE.Match(last)
+}
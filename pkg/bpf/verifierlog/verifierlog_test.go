@@ -0,0 +1,112 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package verifierlog
+
+import "testing"
+
+func TestParseEmpty(t *testing.T) {
+	report, err := Parse(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Partial {
+		t.Error("empty log should not be marked partial")
+	}
+	if len(report.Instructions) != 0 || len(report.Functions) != 0 {
+		t.Error("empty log should produce an empty report")
+	}
+}
+
+func TestParseInstructionLevel(t *testing.T) {
+	log := []byte(
+		"0: (bf) r0 = r1 ; R0_w=ctx(off=0,imm=0) R1=ctx(off=0,imm=0)\n" +
+			"1: (05) goto pc+1\n" +
+			"2: (b7) r0 = 0\n" +
+			"3: (95) exit\n" +
+			"func#1 @4\n" +
+			"stack depth 16+0\n" +
+			"processed 4 insns (limit 1000000) max_states_per_insn 1 total_states 2 peak_states 2 mark_read 1\n",
+	)
+
+	report, err := Parse(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := 4, len(report.Instructions); want != got {
+		t.Fatalf("unexpected instruction count: want: %d, got: %d", want, got)
+	}
+
+	first := report.Instructions[0]
+	if want, got := "(bf) r0 = r1", first.Text; want != got {
+		t.Errorf("unexpected instruction text: want: %q, got: %q", want, got)
+	}
+	if want, got := "ctx(off=0,imm=0)", first.State["R0_w"]; want != got {
+		t.Errorf("unexpected register state: want: %q, got: %q", want, got)
+	}
+
+	jump := report.Instructions[1]
+	if !jump.Jump {
+		t.Fatal("expected instruction 1 to be detected as a jump")
+	}
+	if want, got := 3, jump.JumpTarget; want != got {
+		t.Errorf("unexpected jump target: want: %d, got: %d", want, got)
+	}
+
+	if want, got := 1, len(report.Functions); want != got {
+		t.Fatalf("unexpected function count: want: %d, got: %d", want, got)
+	}
+	if want, got := 16, report.Functions[0].StackDepth; want != got {
+		t.Errorf("unexpected stack depth: want: %d, got: %d", want, got)
+	}
+
+	if want, got := 4, report.Summary.ProcessedInsns; want != got {
+		t.Errorf("unexpected processed insns: want: %d, got: %d", want, got)
+	}
+
+	if report.Partial {
+		t.Error("complete log should not be marked partial")
+	}
+}
+
+func TestParseSummaryIndependentMaxima(t *testing.T) {
+	// func#0 processes the most instructions but has modest state; func#1
+	// processes fewer instructions but peaks at more states. Summary must
+	// report the worst of both, not just the fields of whichever line has
+	// the highest ProcessedInsns.
+	log := []byte(
+		"processed 100 insns (limit 1000000) max_states_per_insn 1 total_states 5 peak_states 2 mark_read 1\n" +
+			"func#1 @50\n" +
+			"processed 9 insns (limit 1000000) max_states_per_insn 4 total_states 20 peak_states 30 mark_read 9\n",
+	)
+
+	report, err := Parse(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Summary{
+		ProcessedInsns:   100,
+		MaxStatesPerInsn: 4,
+		TotalStates:      20,
+		PeakStates:       30,
+		MarkRead:         9,
+	}
+	if got := report.Summary; got != want {
+		t.Errorf("unexpected summary: want: %+v, got: %+v", want, got)
+	}
+}
+
+func TestParseTruncated(t *testing.T) {
+	log := []byte("0: (bf) r0 = r1\n1: (b7) r0 = 0\n2: (95")
+
+	report, err := Parse(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !report.Partial {
+		t.Error("log cut off mid-instruction should be marked partial")
+	}
+}
@@ -0,0 +1,142 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package probes
+
+import (
+	"fmt"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"golang.org/x/sys/unix"
+)
+
+// FeatureProbes is a queryable snapshot of the BPF-related features
+// supported by the running kernel. It is populated once at agent startup
+// and consulted by packages that need to adapt their datapath to the
+// running kernel, such as pkg/bpf's program pruning.
+type FeatureProbes struct {
+	progTypes map[ebpf.ProgramType]bool
+	mapTypes  map[ebpf.MapType]bool
+	helpers   map[progHelper]bool
+	version   KernelVersion
+}
+
+// KernelVersion is a parsed `uname -r` version, used to gate programs that
+// depend on behaviour rather than a probeable type or helper.
+type KernelVersion struct {
+	Major, Minor, Patch int
+}
+
+// AtLeast reports whether v is greater than or equal to min.
+func (v KernelVersion) AtLeast(min KernelVersion) bool {
+	if v.Major != min.Major {
+		return v.Major > min.Major
+	}
+	if v.Minor != min.Minor {
+		return v.Minor > min.Minor
+	}
+	return v.Patch >= min.Patch
+}
+
+type progHelper struct {
+	prog   ebpf.ProgramType
+	helper asm.BuiltinFunc
+}
+
+// probedProgramTypes, probedMapTypes and probedHelpers enumerate the
+// features the Cilium datapath conditionally depends on. Extend these
+// lists as new conditional features are added rather than probing
+// everything the kernel knows about.
+var (
+	probedProgramTypes = []ebpf.ProgramType{
+		ebpf.SchedCLS,
+		ebpf.XDP,
+		ebpf.CGroupSockAddr,
+		ebpf.SockOps,
+		ebpf.LSM,
+	}
+
+	probedMapTypes = []ebpf.MapType{
+		ebpf.LPMTrie,
+		ebpf.LRUHash,
+		ebpf.Queue,
+	}
+
+	probedHelpers = []progHelper{
+		{ebpf.SchedCLS, asm.FnRedirectNeigh},
+		{ebpf.SchedCLS, asm.FnRedirectPeer},
+		{ebpf.XDP, asm.FnXdpDynptrFromSkb},
+	}
+)
+
+// NewFeatureProbes probes the running kernel for the program types, map
+// types and helpers Cilium's datapath cares about, and returns the
+// resulting FeatureProbes. Probing a type creates and immediately discards
+// a minimal object of that type; the kernel rejects unsupported types at
+// creation time, which is sufficient for our purposes.
+func NewFeatureProbes() (*FeatureProbes, error) {
+	version, err := kernelVersion()
+	if err != nil {
+		return nil, fmt.Errorf("probing kernel version: %w", err)
+	}
+
+	fp := &FeatureProbes{
+		progTypes: make(map[ebpf.ProgramType]bool),
+		mapTypes:  make(map[ebpf.MapType]bool),
+		helpers:   make(map[progHelper]bool),
+		version:   version,
+	}
+
+	for _, t := range probedProgramTypes {
+		fp.progTypes[t] = ebpf.HaveProgramType(t) == nil
+	}
+	for _, t := range probedMapTypes {
+		fp.mapTypes[t] = ebpf.HaveMapType(t) == nil
+	}
+	for _, h := range probedHelpers {
+		fp.helpers[h] = ebpf.HaveProgramHelper(h.prog, h.helper) == nil
+	}
+
+	return fp, nil
+}
+
+// HaveProgramType reports whether the kernel supports loading programs of
+// type t.
+func (fp *FeatureProbes) HaveProgramType(t ebpf.ProgramType) bool {
+	return fp.progTypes[t]
+}
+
+// HaveMapType reports whether the kernel supports creating maps of type t.
+func (fp *FeatureProbes) HaveMapType(t ebpf.MapType) bool {
+	return fp.mapTypes[t]
+}
+
+// HaveProgramHelper reports whether the kernel allows programs of type prog
+// to call helper.
+func (fp *FeatureProbes) HaveProgramHelper(prog ebpf.ProgramType, helper asm.BuiltinFunc) bool {
+	return fp.helpers[progHelper{prog, helper}]
+}
+
+// KernelVersion returns the running kernel's version.
+func (fp *FeatureProbes) KernelVersion() KernelVersion {
+	return fp.version
+}
+
+// kernelVersion parses the release string returned by uname(2) into a
+// KernelVersion, ignoring any distro suffix after the patch level.
+func kernelVersion() (KernelVersion, error) {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return KernelVersion{}, err
+	}
+
+	release := unix.ByteSliceToString(uts.Release[:])
+
+	var v KernelVersion
+	if _, err := fmt.Sscanf(release, "%d.%d.%d", &v.Major, &v.Minor, &v.Patch); err != nil {
+		return KernelVersion{}, fmt.Errorf("parsing kernel release %q: %w", release, err)
+	}
+
+	return v, nil
+}